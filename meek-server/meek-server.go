@@ -9,26 +9,49 @@
 //
 // The server runs in HTTPS mode by default, and the --cert and --key options
 // are required. Use the --disable-tls option to run with plain HTTP.
+//
+// --cert and --key may each be given more than once (or as comma-separated
+// lists) to serve several certificates from one process; the certificate
+// whose name matches the TLS ClientHello's SNI server name is used, falling
+// back to the first one given.
+//
+// When TLS is enabled, HTTP/2 is offered via ALPN by default; pass
+// --http2=false to restrict clients to HTTP/1.1.
+//
+// A POST with an empty body or an X-Meek-Poll header is treated as a long
+// poll: instead of returning right away, the server waits up to
+// --long-poll-timeout for data to arrive from the OR port before responding.
+//
+// As an alternative to --cert/--key, --acme-hostnames (with --acme-cache-dir)
+// obtains and renews certificates automatically via ACME, using an HTTP-01
+// challenge listener on --acme-http-addr (":80" by default).
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
 	"path"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
 )
 
 import "github.com/Yawning/goptlib"
+import "golang.org/x/crypto/acme/autocert"
+import "golang.org/x/net/http2"
 
 const (
 	ptMethodName = "meek"
@@ -48,14 +71,18 @@ const (
 	// Cull unused session ids (with their corresponding OR port connection)
 	// if we haven't seen any activity for this long.
 	maxSessionStaleness = 120 * time.Second
+	// Default value of the --shutdown-timeout flag: how long to wait for
+	// in-flight requests to finish during a graceful shutdown before
+	// giving up and closing connections forcibly.
+	defaultShutdownTimeout = 30 * time.Second
+	// Default value of the --long-poll-timeout flag: how long a request
+	// with an empty body or an X-Meek-Poll header may block waiting for
+	// data from the OR port.
+	defaultLongPollTimeout = 30 * time.Second
 )
 
 var ptInfo pt.ServerInfo
 
-// When a connection handler starts, +1 is written to this channel; when it
-// ends, -1 is written.
-var handlerChan = make(chan int)
-
 func httpBadRequest(w http.ResponseWriter) {
 	http.Error(w, "Bad request.\n", http.StatusBadRequest)
 }
@@ -67,9 +94,30 @@ func httpInternalServerError(w http.ResponseWriter) {
 // Every session id maps to an existing OR port connection, which we keep open
 // between received requests. The first time we see a new session id, we create
 // a new OR port connection.
+//
+// A dedicated goroutine (readPump) continuously reads from Or into buf, so
+// that bytes the OR side produces between client requests aren't stuck
+// waiting for the next POST to go pick them up. buf is capped at
+// maxPayloadLength; readPump blocks (via cond) once it's full until transact
+// drains some of it. cond also wakes up anyone in transact blocked waiting
+// for new bytes to arrive.
 type Session struct {
 	Or       *net.TCPConn
 	LastSeen time.Time
+
+	lock   sync.Mutex
+	cond   *sync.Cond
+	buf    []byte
+	closed bool
+}
+
+// NewSession creates a Session wrapping or and starts its read pump.
+func NewSession(or *net.TCPConn) *Session {
+	session := &Session{Or: or}
+	session.cond = sync.NewCond(&session.lock)
+	session.Touch()
+	go session.readPump()
+	return session
 }
 
 // Mark a session as having been seen just now.
@@ -82,26 +130,129 @@ func (session *Session) IsExpired() bool {
 	return time.Since(session.LastSeen) > maxSessionStaleness
 }
 
+// readPump reads from session.Or until it errors (including being closed by
+// Close), appending everything read to session.buf. session.buf is a
+// bounded FIFO buffer (capacity maxPayloadLength): each Read is sized to the
+// room remaining under that cap, so session.buf never grows past it, and
+// readPump blocks once it's full, resuming once transact has drained some of
+// it via take.
+func (session *Session) readPump() {
+	for {
+		session.lock.Lock()
+		for len(session.buf) >= maxPayloadLength && !session.closed {
+			session.cond.Wait()
+		}
+		if session.closed {
+			session.lock.Unlock()
+			return
+		}
+		room := maxPayloadLength - len(session.buf)
+		session.lock.Unlock()
+
+		readBuf := make([]byte, room)
+		n, err := session.Or.Read(readBuf)
+
+		session.lock.Lock()
+		if n > 0 {
+			session.buf = append(session.buf, readBuf[:n]...)
+			session.cond.Broadcast()
+		}
+		if err != nil {
+			session.closed = true
+			session.cond.Broadcast()
+			session.lock.Unlock()
+			return
+		}
+		session.lock.Unlock()
+	}
+}
+
+// take removes and returns up to maxPayloadLength bytes of whatever is
+// currently buffered, waking readPump if it was waiting for room.
+func (session *Session) take() []byte {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	n := len(session.buf)
+	if n > maxPayloadLength {
+		n = maxPayloadLength
+	}
+	data := session.buf[:n:n]
+	session.buf = session.buf[n:]
+	session.cond.Broadcast()
+	return data
+}
+
+// awaitData blocks until there is buffered data, the session is closed, or
+// timeout elapses, whichever comes first.
+func (session *Session) awaitData(timeout time.Duration) {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	if len(session.buf) > 0 || session.closed {
+		return
+	}
+	timedOut := false
+	timer := time.AfterFunc(timeout, func() {
+		session.lock.Lock()
+		timedOut = true
+		session.lock.Unlock()
+		session.cond.Broadcast()
+	})
+	defer timer.Stop()
+	for len(session.buf) == 0 && !session.closed && !timedOut {
+		session.cond.Wait()
+	}
+}
+
+// IsClosed reports whether the OR port connection has been closed, either by
+// Close or because readPump hit an error or EOF reading from it.
+func (session *Session) IsClosed() bool {
+	session.lock.Lock()
+	defer session.lock.Unlock()
+	return session.closed
+}
+
+// Close closes the OR port connection and stops readPump.
+func (session *Session) Close() {
+	session.Or.Close()
+	session.lock.Lock()
+	session.closed = true
+	session.lock.Unlock()
+	session.cond.Broadcast()
+}
+
 // There is one state per HTTP listener. In the usual case there is just one
 // listener, so there is just one global state. State also serves as the http
 // Handler.
 type State struct {
 	sessionMap map[string]*Session
 	lock       sync.Mutex
+	// Closed to tell the ExpireSessions goroutine to stop.
+	done chan struct{}
+	// How long a request with an empty body or an X-Meek-Poll header may
+	// block in transact waiting for data from the OR port. Zero disables
+	// long polling and always uses turnaroundTimeout.
+	longPollTimeout time.Duration
 }
 
-func NewState() *State {
+func NewState(longPollTimeout time.Duration) *State {
 	state := new(State)
 	state.sessionMap = make(map[string]*Session)
+	state.done = make(chan struct{})
+	state.longPollTimeout = longPollTimeout
 	return state
 }
 
-func (state *State) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	handlerChan <- 1
-	defer func() {
-		handlerChan <- -1
-	}()
+// Stop tells the state's background goroutines (currently just
+// ExpireSessions) to exit. It is safe to call more than once.
+func (state *State) Stop() {
+	select {
+	case <-state.done:
+	default:
+		close(state.done)
+	}
+}
 
+func (state *State) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	switch req.Method {
 	case "GET":
 		state.Get(w, req)
@@ -137,7 +288,7 @@ func (state *State) GetSession(sessionId string, req *http.Request) (*Session, e
 		if err != nil {
 			return nil, err
 		}
-		session = &Session{Or: or}
+		session = NewSession(or)
 		state.sessionMap[sessionId] = session
 	}
 	session.Touch()
@@ -145,32 +296,37 @@ func (state *State) GetSession(sessionId string, req *http.Request) (*Session, e
 	return session, nil
 }
 
-// Feed the body of req into the OR port, and write any data read from the OR
-// port back to w.
-func transact(session *Session, w http.ResponseWriter, req *http.Request) error {
+// Feed the body of req into the OR port, and write any data buffered by
+// session's read pump back to w. Ordinarily this waits only turnaroundTimeout
+// for data to arrive; a request with an empty body or an X-Meek-Poll header
+// instead waits up to longPollTimeout, letting a client long-poll for
+// downstream data instead of spending a round trip on an empty response.
+func transact(session *Session, w http.ResponseWriter, req *http.Request, longPollTimeout time.Duration) error {
 	body := http.MaxBytesReader(w, req.Body, maxPayloadLength+1)
-	_, err := io.Copy(session.Or, body)
+	n, err := io.Copy(session.Or, body)
 	if err != nil {
-		return errors.New(fmt.Sprintf("copying body to ORPort: %s", err))
+		return fmt.Errorf("copying body to ORPort: %s", err)
 	}
 
-	buf := make([]byte, maxPayloadLength)
-	session.Or.SetReadDeadline(time.Now().Add(turnaroundTimeout))
-	n, err := session.Or.Read(buf)
-	if err != nil {
-		if e, ok := err.(net.Error); !ok || !e.Timeout() {
-			httpInternalServerError(w)
-			return errors.New(fmt.Sprintf("reading from ORPort: %s", err))
-		}
+	timeout := turnaroundTimeout
+	if longPollTimeout > 0 && (n == 0 || req.Header.Get("X-Meek-Poll") != "") {
+		timeout = longPollTimeout
+	}
+	session.awaitData(timeout)
+
+	data := session.take()
+	if len(data) == 0 && session.IsClosed() {
+		httpInternalServerError(w)
+		return errors.New("OR port connection closed")
 	}
-	// log.Printf("read %d bytes from ORPort: %q", n, buf[:n])
+	// log.Printf("read %d bytes from ORPort: %q", len(data), data)
 	// Set a Content-Type to prevent Go and the CDN from trying to guess.
 	w.Header().Set("Content-Type", "application/octet-stream")
-	n, err = w.Write(buf[:n])
+	_, err = w.Write(data)
 	if err != nil {
-		return errors.New(fmt.Sprintf("writing to response: %s", err))
+		return fmt.Errorf("writing to response: %s", err)
 	}
-	// log.Printf("wrote %d bytes to response", n)
+	// log.Printf("wrote %d bytes to response", len(data))
 	return nil
 }
 
@@ -189,7 +345,7 @@ func (state *State) Post(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	err = transact(session, w, req)
+	err = transact(session, w, req, state.longPollTimeout)
 	if err != nil {
 		log.Print(err)
 		state.CloseSession(sessionId)
@@ -205,20 +361,27 @@ func (state *State) CloseSession(sessionId string) {
 	// log.Printf("closing session %q", sessionId)
 	session, ok := state.sessionMap[sessionId]
 	if ok {
-		session.Or.Close()
+		session.Close()
 		delete(state.sessionMap, sessionId)
 	}
 }
 
-// Loop forever, checking for expired sessions and removing them.
+// Loop until told to stop (via state.done), checking for expired sessions and
+// removing them.
 func (state *State) ExpireSessions() {
+	ticker := time.NewTicker(maxSessionStaleness / 2)
+	defer ticker.Stop()
 	for {
-		time.Sleep(maxSessionStaleness / 2)
+		select {
+		case <-state.done:
+			return
+		case <-ticker.C:
+		}
 		state.lock.Lock()
 		for sessionId, session := range state.sessionMap {
 			if session.IsExpired() {
 				// log.Printf("deleting expired session %q", sessionId)
-				session.Or.Close()
+				session.Close()
 				delete(state.sessionMap, sessionId)
 			}
 		}
@@ -226,20 +389,113 @@ func (state *State) ExpireSessions() {
 	}
 }
 
-func listenTLS(network string, addr *net.TCPAddr, certFilename, keyFilename string) (net.Listener, error) {
+// stringListFlag accumulates the values of a flag that may be repeated on the
+// command line (e.g. --cert a.pem --cert b.pem), with each occurrence also
+// split on commas (e.g. --cert a.pem,b.pem), for convenience. It is used for
+// both file paths (--cert, --key) and hostnames (--acme-hostnames).
+type stringListFlag []string
+
+func (f *stringListFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *stringListFlag) Set(value string) error {
+	for _, v := range strings.Split(value, ",") {
+		if v != "" {
+			*f = append(*f, v)
+		}
+	}
+	return nil
+}
+
+// parseCertificateChain reads certFilename and decodes every "CERTIFICATE"
+// PEM block it contains, in order. It is an error for the file to contain no
+// certificates.
+func parseCertificateChain(certFilename string) ([]*x509.Certificate, error) {
+	pemData, err := ioutil.ReadFile(certFilename)
+	if err != nil {
+		return nil, err
+	}
+	var chain []*x509.Certificate
+	rest := pemData
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", certFilename, err)
+		}
+		chain = append(chain, cert)
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("%s: no CERTIFICATE blocks found", certFilename)
+	}
+	return chain, nil
+}
+
+// loadCertificate is like tls.LoadX509KeyPair, except that it also parses the
+// certificate chain with parseCertificateChain and attaches the leaf
+// certificate as cert.Leaf, so that listenTLS can match it against a TLS
+// ClientHello's requested SNI server name.
+func loadCertificate(certFilename, keyFilename string) (tls.Certificate, error) {
+	chain, err := parseCertificateChain(certFilename)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	cert, err := tls.LoadX509KeyPair(certFilename, keyFilename)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	cert.Leaf = chain[0]
+	return cert, nil
+}
+
+func listenTLS(network string, addr *net.TCPAddr, certFilenames, keyFilenames []string, http2Enabled bool) (net.Listener, error) {
 	// This is cribbed from the source of net/http.Server.ListenAndServeTLS.
 	// We have to separate the Listen and Serve parts because we need to
 	// report the listening address before entering Serve (which is an
 	// infinite loop).
 	// https://groups.google.com/d/msg/Golang-nuts/3F1VRCCENp8/3hcayZiwYM8J
+	if len(certFilenames) != len(keyFilenames) {
+		return nil, fmt.Errorf("the number of --cert and --key options must match")
+	}
+
 	config := &tls.Config{}
-	config.NextProtos = []string{"http/1.1"}
+	if http2Enabled {
+		// Advertise h2 via ALPN so clients that support it get
+		// multiplexed streams over the one TLS connection, in addition
+		// to plain HTTP/1.1 for those that don't.
+		config.NextProtos = []string{"h2", "http/1.1"}
+	} else {
+		config.NextProtos = []string{"http/1.1"}
+	}
 
-	var err error
-	config.Certificates = make([]tls.Certificate, 1)
-	config.Certificates[0], err = tls.LoadX509KeyPair(certFilename, keyFilename)
-	if err != nil {
-		return nil, err
+	config.Certificates = make([]tls.Certificate, len(certFilenames))
+	for i, certFilename := range certFilenames {
+		var err error
+		config.Certificates[i], err = loadCertificate(certFilename, keyFilenames[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Pick a certificate by SNI server name, falling back to the first
+	// certificate when SNI is absent or doesn't match any certificate we
+	// have, consistent with the default behavior of crypto/tls.
+	config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if hello.ServerName != "" {
+			for i := range config.Certificates {
+				if config.Certificates[i].Leaf.VerifyHostname(hello.ServerName) == nil {
+					return &config.Certificates[i], nil
+				}
+			}
+		}
+		return &config.Certificates[0], nil
 	}
 
 	conn, err := net.ListenTCP(network, addr)
@@ -252,53 +508,171 @@ func listenTLS(network string, addr *net.TCPAddr, certFilename, keyFilename stri
 	return tlsListener, nil
 }
 
-func startListener(network string, addr *net.TCPAddr) (net.Listener, error) {
+// listenTLSAutocert is like listenTLS, but obtains certificates automatically
+// from manager (an ACME provider such as Let's Encrypt) instead of loading
+// them from files. hostnames is the same list manager's HostPolicy restricts
+// to; it's used here to fetch a certificate once up front, so that
+// configuration problems (DNS not pointing here yet, the HTTP-01 challenge
+// listener being unreachable, etc.) are reported at startup instead of on the
+// first real connection.
+func listenTLSAutocert(network string, addr *net.TCPAddr, manager *autocert.Manager, hostnames []string, http2Enabled bool) (net.Listener, error) {
+	if _, err := manager.GetCertificate(&tls.ClientHelloInfo{ServerName: hostnames[0]}); err != nil {
+		return nil, fmt.Errorf("ACME: failed to obtain a certificate for %s: %s", hostnames[0], err)
+	}
+
+	config := &tls.Config{
+		GetCertificate: manager.GetCertificate,
+	}
+	if http2Enabled {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	} else {
+		config.NextProtos = []string{"http/1.1"}
+	}
+
+	conn, err := net.ListenTCP(network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	return tls.NewListener(conn, config), nil
+}
+
+// runningServer bundles a listener with the http.Server and State serving it,
+// so that main can shut all three down together.
+type runningServer struct {
+	ln     net.Listener
+	server *http.Server
+	state  *State
+}
+
+func startListener(network string, addr *net.TCPAddr, longPollTimeout time.Duration) (*runningServer, error) {
 	ln, err := net.ListenTCP(network, addr)
 	if err != nil {
 		return nil, err
 	}
 	log.Printf("listening with plain HTTP on %s", ln.Addr())
-	return startServer(ln)
+	return startServer(ln, false, longPollTimeout), nil
 }
 
-func startListenerTLS(network string, addr *net.TCPAddr, certFilename, keyFilename string) (net.Listener, error) {
-	ln, err := listenTLS(network, addr, certFilename, keyFilename)
+func startListenerTLS(network string, addr *net.TCPAddr, certFilenames, keyFilenames []string, http2Enabled bool, longPollTimeout time.Duration) (*runningServer, error) {
+	ln, err := listenTLS(network, addr, certFilenames, keyFilenames, http2Enabled)
 	if err != nil {
 		return nil, err
 	}
 	log.Printf("listening with HTTPS on %s", ln.Addr())
-	return startServer(ln)
+	return startServer(ln, http2Enabled, longPollTimeout), nil
+}
+
+func startListenerTLSAutocert(network string, addr *net.TCPAddr, manager *autocert.Manager, hostnames []string, http2Enabled bool, longPollTimeout time.Duration) (*runningServer, error) {
+	ln, err := listenTLSAutocert(network, addr, manager, hostnames, http2Enabled)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("listening with HTTPS (ACME certificate) on %s", ln.Addr())
+	return startServer(ln, http2Enabled, longPollTimeout), nil
 }
 
-func startServer(ln net.Listener) (net.Listener, error) {
-	state := NewState()
+// startAutocertChallengeListener binds addr (typically ":80") and serves
+// manager's HTTP-01 ACME challenge handler there, falling back to a regular
+// meek State for any request that isn't a challenge. This lets an operator
+// run meek over plain HTTP on the same address Let's Encrypt uses to
+// validate domain ownership.
+func startAutocertChallengeListener(addr string, manager *autocert.Manager, longPollTimeout time.Duration) (*runningServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("listening for ACME HTTP-01 challenges on %s", ln.Addr())
+
+	state := NewState(longPollTimeout)
 	go state.ExpireSessions()
+	// See the matching comment in startServer: Read/WriteTimeout must
+	// cover however long a long-polling request may block in transact.
+	timeout := readWriteTimeout + longPollTimeout
+	server := &http.Server{
+		Handler:      manager.HTTPHandler(state),
+		ReadTimeout:  timeout,
+		WriteTimeout: timeout,
+	}
+	go func() {
+		err := server.Serve(ln)
+		if err != nil && err != http.ErrServerClosed {
+			log.Printf("Error in Serve: %s", err)
+		}
+	}()
+	return &runningServer{ln: ln, server: server, state: state}, nil
+}
+
+func startServer(ln net.Listener, http2Enabled bool, longPollTimeout time.Duration) *runningServer {
+	state := NewState(longPollTimeout)
+	go state.ExpireSessions()
+	// A long-polling handler can legitimately block in transact for up to
+	// longPollTimeout before it writes anything, so the server's own
+	// Read/WriteTimeout (which would otherwise force-close the connection
+	// out from under it) must be stretched to cover that wait too.
+	timeout := readWriteTimeout + longPollTimeout
 	server := &http.Server{
 		Handler:      state,
-		ReadTimeout:  readWriteTimeout,
-		WriteTimeout: readWriteTimeout,
+		ReadTimeout:  timeout,
+		WriteTimeout: timeout,
+	}
+	if http2Enabled {
+		if err := http2.ConfigureServer(server, nil); err != nil {
+			log.Printf("error configuring HTTP/2, continuing without it: %s", err)
+		}
 	}
 	go func() {
-		defer ln.Close()
 		err := server.Serve(ln)
-		if err != nil {
+		if err != nil && err != http.ErrServerClosed {
 			log.Printf("Error in Serve: %s", err)
 		}
 	}()
-	return ln, nil
+	return &runningServer{ln: ln, server: server, state: state}
+}
+
+// shutdown gracefully stops rs's http.Server, giving in-flight requests up to
+// timeout to finish. If the deadline passes first, it falls back to closing
+// the listener and any open connections immediately.
+func (rs *runningServer) shutdown(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	if err := rs.server.Shutdown(ctx); err != nil {
+		log.Printf("graceful shutdown of %s timed out, closing forcibly: %s", rs.ln.Addr(), err)
+		rs.server.Close()
+	}
+	rs.state.Stop()
+}
+
+// close closes rs's listener and any open connections immediately, without
+// waiting for in-flight requests to finish.
+func (rs *runningServer) close() {
+	rs.server.Close()
+	rs.state.Stop()
 }
 
 func main() {
 	var disableTLS bool
-	var certFilename, keyFilename string
+	var certFilenames, keyFilenames stringListFlag
+	var http2Enabled bool
 	var logFilename string
 	var port int
+	var shutdownTimeout time.Duration
+	var longPollTimeout time.Duration
+	var acmeHostnames stringListFlag
+	var acmeCacheDir string
+	var acmeHTTPAddr string
 
 	flag.BoolVar(&disableTLS, "disable-tls", false, "don't use HTTPS")
-	flag.StringVar(&certFilename, "cert", "", "TLS certificate file (required without --disable-tls)")
-	flag.StringVar(&keyFilename, "key", "", "TLS private key file (required without --disable-tls)")
+	flag.Var(&certFilenames, "cert", "TLS certificate file (required without --disable-tls or --acme-hostnames); may be repeated or comma-separated to serve multiple certificates by SNI")
+	flag.Var(&keyFilenames, "key", "TLS private key file, matching --cert one-to-one (required without --disable-tls or --acme-hostnames)")
+	flag.BoolVar(&http2Enabled, "http2", true, "offer HTTP/2 via ALPN when TLS is enabled")
 	flag.StringVar(&logFilename, "log", "", "name of log file")
 	flag.IntVar(&port, "port", 0, "port to listen on")
+	flag.DurationVar(&shutdownTimeout, "shutdown-timeout", defaultShutdownTimeout, "time to wait for in-flight requests to finish on shutdown")
+	flag.DurationVar(&longPollTimeout, "long-poll-timeout", defaultLongPollTimeout, "how long a request with an empty body or X-Meek-Poll header may block waiting for OR-port data; 0 disables long polling")
+	flag.Var(&acmeHostnames, "acme-hostnames", "hostnames to automatically obtain TLS certificates for via ACME (comma-separated or repeatable); mutually exclusive with --cert/--key")
+	flag.StringVar(&acmeCacheDir, "acme-cache-dir", "", "directory to cache ACME account keys and certificates in (required with --acme-hostnames)")
+	flag.StringVar(&acmeHTTPAddr, "acme-http-addr", ":80", "address to listen on for ACME HTTP-01 challenges (also serves plain-HTTP meek)")
 	flag.Parse()
 
 	if logFilename != "" {
@@ -310,14 +684,37 @@ func main() {
 		log.SetOutput(f)
 	}
 
+	acmeEnabled := len(acmeHostnames) != 0
+	if acmeEnabled && (len(certFilenames) != 0 || len(keyFilenames) != 0) {
+		log.Fatalf("The --acme-hostnames option is not allowed together with --cert/--key.\n")
+	}
 	if disableTLS {
-		if certFilename != "" || keyFilename != "" {
+		if len(certFilenames) != 0 || len(keyFilenames) != 0 {
 			log.Fatalf("The --cert and --key options are not allowed with --disable-tls.\n")
 		}
+		if acmeEnabled {
+			log.Fatalf("The --acme-hostnames option is not allowed with --disable-tls.\n")
+		}
+	} else if acmeEnabled {
+		if acmeCacheDir == "" {
+			log.Fatalf("The --acme-cache-dir option is required with --acme-hostnames.\n")
+		}
 	} else {
-		if certFilename == "" || keyFilename == "" {
+		if len(certFilenames) == 0 || len(keyFilenames) == 0 {
 			log.Fatalf("The --cert and --key options are required.\n")
 		}
+		if len(certFilenames) != len(keyFilenames) {
+			log.Fatalf("The number of --cert and --key options must match.\n")
+		}
+	}
+
+	var acmeManager *autocert.Manager
+	if acmeEnabled {
+		acmeManager = &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(acmeHostnames...),
+			Cache:      autocert.DirCache(acmeCacheDir),
+		}
 	}
 
 	var err error
@@ -327,63 +724,84 @@ func main() {
 	}
 
 	log.Printf("starting")
-	listeners := make([]net.Listener, 0)
+	listeners := make([]*runningServer, 0)
+
+	// The HTTP-01 challenge listener must be up and reachable on
+	// --acme-http-addr before we ask the ACME manager for any certificate
+	// below: on a fresh cache, GetCertificate blocks on an authorization
+	// that the CA validates by hitting this listener, so starting it
+	// afterward would make the very first run fail.
+	var acmeChallengeErr error
+	if acmeEnabled {
+		var rs *runningServer
+		rs, acmeChallengeErr = startAutocertChallengeListener(acmeHTTPAddr, acmeManager, longPollTimeout)
+		if acmeChallengeErr != nil {
+			log.Printf("ACME HTTP-01 challenge listener: %s", acmeChallengeErr)
+		} else {
+			listeners = append(listeners, rs)
+		}
+	}
+
 	for _, bindaddr := range ptInfo.Bindaddrs {
 		if port != 0 {
 			bindaddr.Addr.Port = port
 		}
 		switch bindaddr.MethodName {
 		case ptMethodName:
-			var ln net.Listener
-			if disableTLS {
-				ln, err = startListener("tcp", bindaddr.Addr)
-			} else {
-				ln, err = startListenerTLS("tcp", bindaddr.Addr, certFilename, keyFilename)
+			var rs *runningServer
+			switch {
+			case disableTLS:
+				rs, err = startListener("tcp", bindaddr.Addr, longPollTimeout)
+			case acmeEnabled && acmeChallengeErr != nil:
+				err = fmt.Errorf("ACME HTTP-01 challenge listener failed to start: %s", acmeChallengeErr)
+			case acmeEnabled:
+				rs, err = startListenerTLSAutocert("tcp", bindaddr.Addr, acmeManager, acmeHostnames, http2Enabled, longPollTimeout)
+			default:
+				rs, err = startListenerTLS("tcp", bindaddr.Addr, certFilenames, keyFilenames, http2Enabled, longPollTimeout)
 			}
 			if err != nil {
 				pt.SmethodError(bindaddr.MethodName, err.Error())
 				break
 			}
-			pt.Smethod(bindaddr.MethodName, ln.Addr())
-			listeners = append(listeners, ln)
+			pt.Smethod(bindaddr.MethodName, rs.ln.Addr())
+			listeners = append(listeners, rs)
 		default:
 			pt.SmethodError(bindaddr.MethodName, "no such method")
 		}
 	}
 	pt.SmethodsDone()
 
-	var numHandlers int = 0
-	var sig os.Signal
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
-	// Wait for first signal.
-	sig = nil
-	for sig == nil {
-		select {
-		case n := <-handlerChan:
-			numHandlers += n
-		case sig = <-sigChan:
-			log.Printf("got signal %s", sig)
-		}
-	}
-	for _, ln := range listeners {
-		ln.Close()
-	}
+	// Wait for first signal, then start a graceful shutdown: each server
+	// gets up to --shutdown-timeout to let in-flight requests (and their
+	// OR-port transactions) finish before it is forced closed.
+	sig := <-sigChan
+	log.Printf("got signal %s, starting graceful shutdown", sig)
 
-	if sig == syscall.SIGTERM {
-		log.Printf("done")
-		return
-	}
+	shutdownDone := make(chan struct{})
+	go func() {
+		var wg sync.WaitGroup
+		for _, rs := range listeners {
+			wg.Add(1)
+			go func(rs *runningServer) {
+				defer wg.Done()
+				rs.shutdown(shutdownTimeout)
+			}(rs)
+		}
+		wg.Wait()
+		close(shutdownDone)
+	}()
 
-	// Wait for second signal or no more handlers.
-	sig = nil
-	for sig == nil && numHandlers != 0 {
-		select {
-		case n := <-handlerChan:
-			numHandlers += n
-		case sig = <-sigChan:
-			log.Printf("got second signal %s", sig)
+	// A second signal short-circuits the graceful wait and forces an
+	// immediate close.
+	select {
+	case <-shutdownDone:
+	case sig = <-sigChan:
+		log.Printf("got second signal %s, closing immediately", sig)
+		for _, rs := range listeners {
+			rs.close()
 		}
 	}
 
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+import "github.com/Yawning/goptlib"
+import "golang.org/x/net/http2"
+
+// writeSelfSignedCert creates a self-signed certificate and key for
+// 127.0.0.1, valid for an hour, and writes them as PEM to certPath and
+// keyPath.
+func writeSelfSignedCert(t *testing.T, certPath, keyPath string) {
+	t.Helper()
+
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating key: %s", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "127.0.0.1"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatalf("creating certificate: %s", err)
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(certPath, certPEM, 0600); err != nil {
+		t.Fatalf("writing cert: %s", err)
+	}
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
+	if err := ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+		t.Fatalf("writing key: %s", err)
+	}
+}
+
+// serveFakeOrPort stands in for a real OR port: for every connection it
+// accepts, it runs handle in its own goroutine, closing the connection when
+// handle returns. It runs until ln is closed.
+func serveFakeOrPort(ln net.Listener, handle func(net.Conn)) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		go func(conn net.Conn) {
+			defer conn.Close()
+			handle(conn)
+		}(conn)
+	}
+}
+
+// echoOrHandler reads from conn until it errors, writing back "echo:"
+// followed by whatever it read.
+func echoOrHandler(conn net.Conn) {
+	buf := make([]byte, maxPayloadLength)
+	for {
+		n, err := conn.Read(buf)
+		if n > 0 {
+			conn.Write(append([]byte("echo:"), buf[:n]...))
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// setupTestServer starts a fake OR port running orHandler and a real
+// meek-server TLS listener pointed at it, and arranges for both to be torn
+// down at the end of the test. It returns the running server and the URL of
+// its root.
+func setupTestServer(t *testing.T, orHandler func(net.Conn), http2Enabled bool, longPollTimeout time.Duration) (*runningServer, string) {
+	t.Helper()
+
+	orLn, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("starting fake OR port: %s", err)
+	}
+	t.Cleanup(func() { orLn.Close() })
+	go serveFakeOrPort(orLn, orHandler)
+
+	savedPtInfo := ptInfo
+	t.Cleanup(func() { ptInfo = savedPtInfo })
+	ptInfo = pt.ServerInfo{OrAddr: orLn.Addr().(*net.TCPAddr)}
+
+	dir := t.TempDir()
+	certPath := filepath.Join(dir, "cert.pem")
+	keyPath := filepath.Join(dir, "key.pem")
+	writeSelfSignedCert(t, certPath, keyPath)
+
+	rs, err := startListenerTLS("tcp", &net.TCPAddr{IP: net.ParseIP("127.0.0.1")},
+		[]string{certPath}, []string{keyPath}, http2Enabled, longPollTimeout)
+	if err != nil {
+		t.Fatalf("starting meek-server TLS listener: %s", err)
+	}
+	t.Cleanup(func() { rs.close() })
+
+	return rs, "https://" + rs.ln.Addr().String() + "/"
+}
+
+// newInsecureHTTP1Client returns a client that trusts no particular
+// certificate and always speaks HTTP/1.1, suitable for talking to the
+// self-signed listener setupTestServer starts.
+func newInsecureHTTP1Client(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"http/1.1"}},
+			// Disable net/http's automatic HTTP/2 upgrade so this client
+			// really speaks HTTP/1.1.
+			TLSNextProto: map[string]func(string, *tls.Conn) http.RoundTripper{},
+		},
+	}
+}
+
+// TestTransactOverHTTP1AndHTTP2 spins up a real meek-server TLS listener with
+// HTTP/2 enabled, points it at a fake OR port, and drives a full
+// client-POST-to-OR-reply transaction through transact over both HTTP/1.1
+// and HTTP/2, dialing each with an ALPN-aware client to confirm the intended
+// protocol is actually the one negotiated.
+func TestTransactOverHTTP1AndHTTP2(t *testing.T) {
+	_, url := setupTestServer(t, echoOrHandler, true, 0)
+
+	for i, tc := range []struct {
+		name           string
+		client         *http.Client
+		wantProtoMajor int
+	}{
+		{
+			name:           "http/1.1",
+			client:         newInsecureHTTP1Client(0),
+			wantProtoMajor: 1,
+		},
+		{
+			name: "h2",
+			client: &http.Client{Transport: &http2.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}},
+			}},
+			wantProtoMajor: 2,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			sessionId := strings.Repeat(string(rune('a'+i)), minSessionIdLength)
+			req, err := http.NewRequest("POST", url, strings.NewReader("ping"))
+			if err != nil {
+				t.Fatalf("building request: %s", err)
+			}
+			req.Header.Set("X-Session-Id", sessionId)
+
+			resp, err := tc.client.Do(req)
+			if err != nil {
+				t.Fatalf("doing request: %s", err)
+			}
+			defer resp.Body.Close()
+
+			if resp.ProtoMajor != tc.wantProtoMajor {
+				t.Errorf("got protocol %s, want HTTP/%d.x", resp.Proto, tc.wantProtoMajor)
+			}
+
+			body, err := ioutil.ReadAll(resp.Body)
+			if err != nil {
+				t.Fatalf("reading response body: %s", err)
+			}
+			if string(body) != "echo:ping" {
+				t.Errorf("got response body %q, want %q", body, "echo:ping")
+			}
+		})
+	}
+}
+
+// TestLongPollWaitsForOrData drives a long-poll request (empty body, so
+// transact waits up to longPollTimeout rather than just turnaroundTimeout)
+// against an OR port that doesn't write anything until after a short delay.
+// The request should block until that write happens and then return
+// promptly, rather than sitting out the full long-poll timeout.
+func TestLongPollWaitsForOrData(t *testing.T) {
+	const writeDelay = 300 * time.Millisecond
+	const longPollTimeout = 5 * time.Second
+
+	_, url := setupTestServer(t, func(conn net.Conn) {
+		time.Sleep(writeDelay)
+		conn.Write([]byte("longpoll-data"))
+	}, false, longPollTimeout)
+
+	sessionId := strings.Repeat("a", minSessionIdLength)
+	req, err := http.NewRequest("POST", url, strings.NewReader(""))
+	if err != nil {
+		t.Fatalf("building request: %s", err)
+	}
+	req.Header.Set("X-Session-Id", sessionId)
+
+	start := time.Now()
+	resp, err := newInsecureHTTP1Client(longPollTimeout).Do(req)
+	if err != nil {
+		t.Fatalf("doing request: %s", err)
+	}
+	defer resp.Body.Close()
+	elapsed := time.Since(start)
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading response body: %s", err)
+	}
+	if string(body) != "longpoll-data" {
+		t.Errorf("got response body %q, want %q", body, "longpoll-data")
+	}
+	if elapsed < writeDelay/2 {
+		t.Errorf("request returned after %s, before the OR port even wrote (after %s); did it not wait at all?", elapsed, writeDelay)
+	}
+	if elapsed >= longPollTimeout {
+		t.Errorf("request took %s, the full longPollTimeout of %s; it should have returned as soon as the OR port wrote", elapsed, longPollTimeout)
+	}
+}
+
+// TestClosedOrSurfacesAsSessionClose checks that once an OR port connection
+// is closed out from under a session, the next POST on that session id gets
+// an error response and the session is dropped from the map, instead of
+// hanging or silently succeeding with no data.
+func TestClosedOrSurfacesAsSessionClose(t *testing.T) {
+	rs, url := setupTestServer(t, func(conn net.Conn) {
+		buf := make([]byte, maxPayloadLength)
+		conn.Read(buf)
+		// Wait out the first POST's turnaroundTimeout, so that it
+		// completes normally and the session stays in the map, then close
+		// without writing anything back, simulating the OR port going
+		// away mid-session.
+		time.Sleep(50 * time.Millisecond)
+	}, false, 0)
+
+	sessionId := strings.Repeat("a", minSessionIdLength)
+	client := newInsecureHTTP1Client(5 * time.Second)
+
+	post := func(body string) *http.Response {
+		t.Helper()
+		req, err := http.NewRequest("POST", url, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("building request: %s", err)
+		}
+		req.Header.Set("X-Session-Id", sessionId)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatalf("doing request: %s", err)
+		}
+		defer resp.Body.Close()
+		return resp
+	}
+
+	// First POST: establishes the session and hands the OR port something
+	// to read before it closes the connection.
+	post("hello")
+
+	// Give readPump time to observe the close.
+	time.Sleep(100 * time.Millisecond)
+
+	// Second POST: the session's OR port connection is now closed, so this
+	// should come back as an internal server error rather than hang.
+	resp := post("are you still there")
+	if resp.StatusCode != http.StatusInternalServerError {
+		t.Errorf("got status %d, want %d", resp.StatusCode, http.StatusInternalServerError)
+	}
+
+	rs.state.lock.Lock()
+	_, stillPresent := rs.state.sessionMap[sessionId]
+	rs.state.lock.Unlock()
+	if stillPresent {
+		t.Errorf("session %q is still in the session map after its OR port closed", sessionId)
+	}
+}
+
+// blackHoleOrHandler accepts a connection and reads from it without ever
+// writing a response, standing in for an OR port that's simply too slow to
+// answer. It gives up after a while so the test doesn't leak a goroutine
+// forever if something goes wrong.
+func blackHoleOrHandler(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, maxPayloadLength)
+	for {
+		if _, err := conn.Read(buf); err != nil {
+			return
+		}
+	}
+}
+
+// TestShutdownFallsBackToCloseOnTimeout checks that shutdown, faced with a
+// request that's still blocked in a long poll, gives up waiting once its
+// timeout elapses and force-closes instead of hanging until the request
+// finishes on its own.
+func TestShutdownFallsBackToCloseOnTimeout(t *testing.T) {
+	const longPollTimeout = 5 * time.Second
+	const shutdownTimeout = 200 * time.Millisecond
+
+	rs, url := setupTestServer(t, blackHoleOrHandler, false, longPollTimeout)
+
+	sessionId := strings.Repeat("a", minSessionIdLength)
+	req, err := http.NewRequest("POST", url, strings.NewReader(""))
+	if err != nil {
+		t.Fatalf("building request: %s", err)
+	}
+	req.Header.Set("X-Session-Id", sessionId)
+
+	requestDone := make(chan error, 1)
+	go func() {
+		resp, err := newInsecureHTTP1Client(longPollTimeout).Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		requestDone <- err
+	}()
+
+	// Wait until the session has actually been created, i.e. the request
+	// is done with GetSession and blocked in its long poll, before pulling
+	// the rug out from under it. Otherwise we might shut down so early
+	// that the request hasn't reached the OR port yet.
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		rs.state.lock.Lock()
+		_, ok := rs.state.sessionMap[sessionId]
+		rs.state.lock.Unlock()
+		if ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("session %q never showed up in the session map", sessionId)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	start := time.Now()
+	rs.shutdown(shutdownTimeout)
+	elapsed := time.Since(start)
+
+	if elapsed >= longPollTimeout {
+		t.Errorf("shutdown took %s, as long as the full longPollTimeout of %s; it should have fallen back to closing", elapsed, longPollTimeout)
+	}
+	if elapsed > 5*shutdownTimeout {
+		t.Errorf("shutdown took %s, much longer than its %s timeout", elapsed, shutdownTimeout)
+	}
+
+	select {
+	case err := <-requestDone:
+		if err == nil {
+			t.Errorf("in-flight request succeeded; expected it to be aborted by the forced close")
+		}
+	case <-time.After(5 * time.Second):
+		t.Errorf("in-flight request never returned after shutdown forced itself closed")
+	}
+}